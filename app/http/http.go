@@ -1,100 +1,226 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-type request struct {
-	HTTPMethod  string
-	Path        string
-	HTTPVersion string
-	HTTPHeaders []string
+const (
+	defaultReadTimeout  = 30 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+	defaultIdleTimeout  = 30 * time.Second
+	defaultWorkerCount  = 64
+	defaultQueueSize    = 128
+)
+
+// maxBodySize bounds the request body read's allocated length up front, so a
+// client can't force an arbitrarily large allocation by sending a huge
+// Content-Length and little or no actual body.
+const maxBodySize = 10 * 1024 * 1024 // 10 MiB
+
+var errBodyTooLarge = errors.New("request body exceeds maximum allowed size")
+
+// minGzipSize is the smallest body we bother compressing; gzip's own framing
+// overhead makes it a net loss below this.
+const minGzipSize = 64
+
+type Request struct {
+	HTTPMethod    string
+	Path          string
+	HTTPVersion   string
+	HTTPHeaders   []string
+	Body          []byte
+	ContentLength int
+	// Params holds the wildcard segment captures from the route pattern
+	// that matched this request, e.g. {"msg": "hello"} for "/echo/{msg}".
+	Params map[string]string
 }
 
-type response struct {
+type Response struct {
 	Status      string
 	HTTPHeaders []string
 	Body        string
 }
 
-func parseHeaders(headers []string) string {
+// Handler produces a Response for a matched Request.
+type Handler func(Request) Response
+
+type route struct {
+	method   string
+	segments []string
+	handler  Handler
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// isWildcard reports whether a route pattern segment, e.g. "{msg}", captures
+// the corresponding path segment.
+func isWildcard(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// parseHeaders turns the raw "Key: value" header lines off the wire into a
+// lookup keyed by header name, preserving repeated headers as multiple
+// values.
+func parseHeaders(headers []string) map[string][]string {
+	parsed := make(map[string][]string, len(headers))
 	for _, header := range headers {
-		if strings.HasPrefix(header, "User-Agent") {
-			return header[len("User-Agent: "):]
+		idx := strings.Index(header, ":")
+		if idx < 0 {
+			continue
 		}
+		key := strings.TrimSpace(header[:idx])
+		value := strings.TrimSpace(header[idx+1:])
+		parsed[key] = append(parsed[key], value)
+	}
+	return parsed
+}
+
+func headerValue(headers map[string][]string, key string) string {
+	if values, ok := headers[key]; ok && len(values) > 0 {
+		return values[0]
 	}
 	return ""
 }
 
-func createDefaultResponse(request request, responseStartLine, body []byte, contentType string) response {
-	return response{
-		Status:      string(responseStartLine),
-		Body:        string(body),
-		HTTPHeaders: []string{"Content-Type: " + contentType, "Content-Length: " + fmt.Sprint(len(body))},
+// acceptsGzip reports whether the client's Accept-Encoding header allows a
+// gzip-encoded response, honoring an explicit rejection such as "gzip;q=0".
+func acceptsGzip(headers map[string][]string) bool {
+	for _, value := range headers["Accept-Encoding"] {
+		for _, encoding := range strings.Split(value, ",") {
+			name, q := parseEncoding(encoding)
+			if strings.EqualFold(name, "gzip") {
+				return q != 0
+			}
+		}
 	}
+	return false
 }
 
-func fetchResponse(request request, dirFlag bool, directory string) response {
-	successful := []byte("HTTP/1.1 200 OK")
-	unSuccessful := []byte("HTTP/1.1 404 Not Found")
-	contentType := "text/plain"
-	body := []byte("")
-	userAgent := ""
+// parseEncoding splits a single Accept-Encoding token, e.g. "gzip;q=0.5",
+// into its coding name and q-value, defaulting to q=1 when absent.
+func parseEncoding(token string) (string, float64) {
+	parts := strings.Split(token, ";")
+	name := strings.TrimSpace(parts[0])
+	q := 1.0
+	for _, param := range parts[1:] {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return name, q
+}
 
-	var responseStartLine []byte
-	var response response
+// gzipEncode compresses body and rewrites res's Content-Encoding and
+// Content-Length accordingly. It is a no-op below minGzipSize or if the
+// client doesn't accept gzip.
+func gzipEncode(res Response, headers map[string][]string) Response {
+	if !acceptsGzip(headers) || len(res.Body) < minGzipSize {
+		return res
+	}
 
-	switch {
-	case request.Path == "/":
-		response = createDefaultResponse(request, successful, body, contentType)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(res.Body)); err != nil {
+		return res
+	}
+	if err := gw.Close(); err != nil {
+		return res
+	}
 
-	case strings.HasPrefix(request.Path, "/echo"):
-		body = []byte(request.Path[len("/echo"):])
-		if len(body) > 1 && body[0] == '/' {
-			body = body[1:]
-		} else {
-			body = []byte("")
+	res.Body = buf.String()
+	res.HTTPHeaders = append(res.HTTPHeaders, "Content-Encoding: gzip")
+	for i, header := range res.HTTPHeaders {
+		if strings.HasPrefix(header, "Content-Length:") {
+			res.HTTPHeaders[i] = "Content-Length: " + fmt.Sprint(len(res.Body))
 		}
+	}
+	return res
+}
 
-		response = createDefaultResponse(request, successful, body, contentType)
-
-	case strings.HasPrefix(request.Path, "/user-agent"):
-		userAgent = parseHeaders(request.HTTPHeaders)
-		body = []byte(userAgent)
+func createDefaultResponse(request Request, responseStartLine, body []byte, contentType string) Response {
+	return Response{
+		Status:      string(responseStartLine),
+		Body:        string(body),
+		HTTPHeaders: []string{"Content-Type: " + contentType, "Content-Length: " + fmt.Sprint(len(body))},
+	}
+}
 
-		response = createDefaultResponse(request, successful, body, contentType)
+// resolveFilePath joins directory and name, rejecting any result that would
+// resolve outside of directory (e.g. a name containing "..").
+func resolveFilePath(directory, name string) (string, error) {
+	dirAbs, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+	filePath, err := filepath.Abs(filepath.Join(directory, name))
+	if err != nil {
+		return "", err
+	}
+	if filePath != dirAbs && !strings.HasPrefix(filePath, dirAbs+string(os.PathSeparator)) {
+		return "", fmt.Errorf("path %q escapes served directory", name)
+	}
+	return filePath, nil
+}
 
-	case strings.HasPrefix(request.Path, "/files"):
-		if !dirFlag {
-			responseStartLine = unSuccessful
-		} else {
-			filePath, _ := filepath.Abs(directory + request.Path[len("/files"):])
+// handleFileUpload writes a POST /files/{name} body to directory, enforcing
+// the octet-stream content type and that name can't escape directory.
+func handleFileUpload(request Request, headers map[string][]string, directory string) Response {
+	if headerValue(headers, "Content-Type") != "application/octet-stream" {
+		return createDefaultResponse(request, []byte("HTTP/1.1 415 Unsupported Media Type"), []byte(""), "text/plain")
+	}
 
-			if _, err := os.Stat(filePath); os.IsNotExist(err) {
-				responseStartLine = unSuccessful
+	filePath, err := resolveFilePath(directory, request.Params["name"])
+	if err != nil {
+		return createDefaultResponse(request, []byte("HTTP/1.1 400 Bad Request"), []byte(""), "text/plain")
+	}
 
-			} else {
-				responseStartLine = successful
-				fileContents, _ := os.ReadFile(filePath)
-				body = fileContents
-				contentType = "application/octet-stream"
-			}
-		}
+	if err := os.WriteFile(filePath, request.Body, 0644); err != nil {
+		return createDefaultResponse(request, []byte("HTTP/1.1 500 Internal Server Error"), []byte(""), "text/plain")
+	}
 
-		response = createDefaultResponse(request, responseStartLine, body, contentType)
+	return createDefaultResponse(request, []byte("HTTP/1.1 201 Created"), []byte(""), "text/plain")
+}
 
-	default:
-		response = createDefaultResponse(request, unSuccessful, body, contentType)
+// serveFile implements GET /files/{name}, returning the named file from
+// directory, or 404 if it doesn't exist.
+func serveFile(request Request, directory string) Response {
+	filePath, err := resolveFilePath(directory, request.Params["name"])
+	if err != nil {
+		return createDefaultResponse(request, []byte("HTTP/1.1 400 Bad Request"), []byte(""), "text/plain")
+	}
 
+	fileContents, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return createDefaultResponse(request, []byte("HTTP/1.1 404 Not Found"), []byte(""), "text/plain")
+	}
+	if err != nil {
+		return createDefaultResponse(request, []byte("HTTP/1.1 500 Internal Server Error"), []byte(""), "text/plain")
 	}
 
-	return response
+	return createDefaultResponse(request, []byte("HTTP/1.1 200 OK"), fileContents, "application/octet-stream")
 }
 
 type HTTP struct {
@@ -102,35 +228,179 @@ type HTTP struct {
 	Listener  net.Listener
 	directory string
 	dirFlag   bool
+	routes    []route
+	wg        sync.WaitGroup
+	closing   chan struct{}
+	// ready is closed once ServeRequests has assigned Listener, giving other
+	// goroutines (Shutdown, callers, tests) a happens-before-safe way to read
+	// it instead of racing the accept-loop goroutine that writes it.
+	ready     chan struct{}
+	connQueue chan net.Conn
+
+	// ReadTimeout bounds how long reading the rest of a single request, once
+	// its request line has arrived, may take. WriteTimeout bounds writing a
+	// response.
+	// IdleTimeout bounds how long a kept-alive connection may sit waiting
+	// for its next request. WorkerCount and QueueSize size the connection
+	// worker pool; once QueueSize connections are already queued, new
+	// connections are rejected with 503 rather than blocking Accept.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	WorkerCount  int
+	QueueSize    int
 }
 
 func NewHTTPServer(directoryFlagPtr string) *HTTP {
 	logger, _ := zap.NewProduction()
 	logger.Info("Starting HTTP Server")
-	if directoryFlagPtr == "" {
-		return &HTTP{logger: logger, directory: directoryFlagPtr, dirFlag: false}
+
+	h := &HTTP{
+		logger:       logger,
+		directory:    directoryFlagPtr,
+		dirFlag:      directoryFlagPtr != "",
+		closing:      make(chan struct{}),
+		ready:        make(chan struct{}),
+		ReadTimeout:  defaultReadTimeout,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  defaultIdleTimeout,
+		WorkerCount:  defaultWorkerCount,
+		QueueSize:    defaultQueueSize,
+	}
+	h.registerDefaultHandlers()
+	return h
+}
+
+// registerDefaultHandlers wires up the server's built-in routes. Embedders
+// can register additional routes with Handle.
+func (h *HTTP) registerDefaultHandlers() {
+	h.Handle("GET", "/", func(req Request) Response {
+		return createDefaultResponse(req, []byte("HTTP/1.1 200 OK"), []byte(""), "text/plain")
+	})
+
+	h.Handle("GET", "/echo/{msg}", func(req Request) Response {
+		return createDefaultResponse(req, []byte("HTTP/1.1 200 OK"), []byte(req.Params["msg"]), "text/plain")
+	})
+
+	h.Handle("GET", "/user-agent", func(req Request) Response {
+		userAgent := headerValue(parseHeaders(req.HTTPHeaders), "User-Agent")
+		return createDefaultResponse(req, []byte("HTTP/1.1 200 OK"), []byte(userAgent), "text/plain")
+	})
+
+	h.Handle("GET", "/files/{name}", func(req Request) Response {
+		if !h.dirFlag {
+			return createDefaultResponse(req, []byte("HTTP/1.1 404 Not Found"), []byte(""), "text/plain")
+		}
+		return serveFile(req, h.directory)
+	})
+
+	h.Handle("POST", "/files/{name}", func(req Request) Response {
+		if !h.dirFlag {
+			return createDefaultResponse(req, []byte("HTTP/1.1 404 Not Found"), []byte(""), "text/plain")
+		}
+		return handleFileUpload(req, parseHeaders(req.HTTPHeaders), h.directory)
+	})
+}
+
+// Ready returns a channel that's closed once ServeRequests has bound
+// Listener, so callers on other goroutines (including Shutdown) can wait on
+// it before reading Listener instead of racing the accept-loop goroutine.
+func (h *HTTP) Ready() <-chan struct{} {
+	return h.ready
+}
+
+// Handle registers handler to serve requests matching method and pattern.
+// pattern may contain a single wildcard segment per path segment, e.g.
+// "/echo/{msg}", whose capture is exposed through Request.Params.
+func (h *HTTP) Handle(method, pattern string, handler Handler) {
+	h.routes = append(h.routes, route{method: method, segments: splitPath(pattern), handler: handler})
+}
+
+// match finds the first registered route whose method and pattern match
+// path, returning its handler and any wildcard captures.
+func (h *HTTP) match(method, path string) (Handler, map[string]string, bool) {
+	pathSegments := splitPath(path)
+
+	for _, r := range h.routes {
+		if r.method != method || len(r.segments) != len(pathSegments) {
+			continue
+		}
+
+		params := make(map[string]string)
+		matched := true
+		for i, segment := range r.segments {
+			if isWildcard(segment) {
+				params[strings.Trim(segment, "{}")] = pathSegments[i]
+				continue
+			}
+			if segment != pathSegments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return r.handler, params, true
+		}
 	}
-	return &HTTP{logger: logger, directory: directoryFlagPtr, dirFlag: true}
+	return nil, nil, false
 }
 
-func (h *HTTP) deserializeRequest(reqBuffer []byte, req *request) {
-	requestLine := strings.Split(string(reqBuffer), "\r\n")
-	startLineSections := strings.Split(requestLine[0], " ")
+// readRequest parses a single request off reader: the request line, headers
+// up to the blank line, and (if present) a Content-Length body. It returns
+// io.EOF when the client has closed the connection before sending anything.
+func (h *HTTP) readRequest(conn net.Conn, reader *bufio.Reader, req *Request) error {
+	conn.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+
+	startLine, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(h.ReadTimeout))
+
+	startLineSections := strings.Split(strings.TrimRight(startLine, "\r\n"), " ")
+	if len(startLineSections) != 3 {
+		return fmt.Errorf("malformed request line: %q", startLine)
+	}
 	req.HTTPMethod = startLineSections[0]
 	req.Path = startLineSections[1]
 	req.HTTPVersion = startLineSections[2]
+	req.HTTPHeaders = nil
+	req.Body = nil
+	req.ContentLength = 0
 
-	for _, header := range requestLine[1:] {
-		if header == "" {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
 			break
 		}
-		req.HTTPHeaders = append(req.HTTPHeaders, header)
+		req.HTTPHeaders = append(req.HTTPHeaders, line)
+	}
+
+	if cl := headerValue(parseHeaders(req.HTTPHeaders), "Content-Length"); cl != "" {
+		length, err := strconv.Atoi(cl)
+		if err != nil || length < 0 {
+			return fmt.Errorf("malformed Content-Length: %q", cl)
+		}
+		if length > maxBodySize {
+			return errBodyTooLarge
+		}
+		req.ContentLength = length
+		req.Body = make([]byte, length)
+		if _, err := io.ReadFull(reader, req.Body); err != nil {
+			return err
+		}
 	}
 
 	h.logger.Info("Deserialized Request: ", zap.Any("request", req))
+	return nil
 }
 
-func (h *HTTP) serializeResponse(res response) []byte {
+func (h *HTTP) serializeResponse(res Response) []byte {
 	response := res.Status + "\r\n"
 
 	for _, header := range res.HTTPHeaders {
@@ -144,58 +414,174 @@ func (h *HTTP) serializeResponse(res response) []byte {
 	return []byte(response)
 }
 
-func (h *HTTP) read(conn net.Conn, request *request) {
-	reqBuffer := make([]byte, 1024)
-	h.logger.Info("Reading request...")
+func (h *HTTP) write(conn net.Conn, response Response) error {
+	conn.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
 
-	d, err := conn.Read(reqBuffer)
+	resp := h.serializeResponse(response)
+	d, err := conn.Write(resp)
 	if err != nil {
-		h.logger.Error("Error reading from connection: " + err.Error())
-		os.Exit(1)
+		return fmt.Errorf("writing response: %w", err)
 	}
-	h.logger.Info("READ: Number of bytes recieved: ", zap.Int("bytes", d))
+	h.logger.Info("WRITE: Number of bytes sent: ", zap.Int("bytes", d))
+	return nil
+}
+
+// handleConnection serves requests off a single connection until the client
+// requests Connection: close, the idle deadline expires, or the request
+// stream can no longer be read, parsed, or written to. A misbehaving
+// connection only ever closes itself; it never brings down the server.
+func (h *HTTP) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
 
-	h.deserializeRequest(reqBuffer, request)
+	for {
+		var request Request
+		if err := h.readRequest(conn, reader, &request); err != nil {
+			if errors.Is(err, errBodyTooLarge) {
+				res := createDefaultResponse(request, []byte("HTTP/1.1 413 Payload Too Large"), []byte(""), "text/plain")
+				res.HTTPHeaders = append(res.HTTPHeaders, "Connection: close")
+				if writeErr := h.write(conn, res); writeErr != nil {
+					h.logger.Error("Error writing to connection: " + writeErr.Error())
+				}
+				return
+			}
+			if err != io.EOF {
+				h.logger.Info("Closing connection: " + err.Error())
+			}
+			return
+		}
+
+		headers := parseHeaders(request.HTTPHeaders)
+
+		var response Response
+		if handler, params, ok := h.match(request.HTTPMethod, request.Path); ok {
+			request.Params = params
+			response = handler(request)
+		} else {
+			response = createDefaultResponse(request, []byte("HTTP/1.1 404 Not Found"), []byte(""), "text/plain")
+		}
+		response = gzipEncode(response, headers)
+
+		closeConn := strings.EqualFold(headerValue(headers, "Connection"), "close")
+		if closeConn {
+			response.HTTPHeaders = append(response.HTTPHeaders, "Connection: close")
+		} else {
+			response.HTTPHeaders = append(response.HTTPHeaders, "Connection: keep-alive")
+		}
+
+		if err := h.write(conn, response); err != nil {
+			h.logger.Error("Closing connection: " + err.Error())
+			return
+		}
+
+		if closeConn {
+			return
+		}
+	}
 }
 
-func (h *HTTP) write(conn net.Conn, response response) {
-	resp := h.serializeResponse(response)
-	d, err := conn.Write(resp)
-	if err != nil {
-		h.logger.Error("Error writing to connection: " + err.Error())
-		os.Exit(1)
+// worker drains connQueue, handling one connection at a time, until
+// ServeRequests closes it. Ranging rather than selecting against closing
+// guarantees every connection already queued at shutdown time is still
+// served (or at least closed) instead of being abandoned mid-queue.
+func (h *HTTP) worker() {
+	defer h.wg.Done()
+	for conn := range h.connQueue {
+		h.handleConnection(conn)
 	}
-	h.logger.Info("READ: Number of bytes recieved: ", zap.Int("bytes", d))
 }
 
-func (h *HTTP) handleConnection(conn net.Conn) {
+// rejectConnection responds 503 to a connection that arrived while the
+// worker queue was full, then closes it without ever handing it to a worker.
+func (h *HTTP) rejectConnection(conn net.Conn) {
 	defer conn.Close()
 
-	var request request
-	var response response
+	res := createDefaultResponse(Request{}, []byte("HTTP/1.1 503 Service Unavailable"), []byte(""), "text/plain")
+	res.HTTPHeaders = append(res.HTTPHeaders, "Connection: close")
 
-	h.read(conn, &request)
-	response = fetchResponse(request, h.dirFlag, h.directory)
-	h.write(conn, response)
+	if err := h.write(conn, res); err != nil {
+		h.logger.Error("Error rejecting connection: " + err.Error())
+	}
 }
 
-func (h *HTTP) ServeRequests(ip string, port string) {
+// ServeRequests binds ip:port and dispatches accepted connections to a
+// bounded pool of WorkerCount workers via a QueueSize-deep queue. When the
+// queue is full, new connections are rejected with 503 rather than blocking
+// Accept. It serves until Shutdown closes the listener, at which point it
+// returns nil.
+func (h *HTTP) ServeRequests(ip string, port string) error {
 	l, err := net.Listen("tcp", ip+":"+port)
 	if err != nil {
-		h.logger.Error("Failed to bind to port " + port + ": " + err.Error())
-		os.Exit(1)
+		return fmt.Errorf("binding to port %s: %w", port, err)
 	}
 
 	h.Listener = l
+	close(h.ready)
+	h.connQueue = make(chan net.Conn, h.QueueSize)
+	// Closing connQueue, rather than leaving it for Shutdown, is what lets
+	// worker's range loop drain whatever is still queued once we stop
+	// accepting, so no queued connection is ever silently abandoned.
+	defer close(h.connQueue)
+
+	for i := 0; i < h.WorkerCount; i++ {
+		h.wg.Add(1)
+		go h.worker()
+	}
+
 	for {
 		c, err := h.Listener.Accept()
 		if err != nil {
-			h.logger.Error("Error accepting connection: " + err.Error())
-			continue
+			select {
+			case <-h.closing:
+				return nil
+			default:
+				h.logger.Error("Error accepting connection: " + err.Error())
+				continue
+			}
 		}
 
 		h.logger.Info("Accepted connection", zap.String("remote", c.RemoteAddr().String()), zap.String("local", c.LocalAddr().String()))
 
-		go h.handleConnection(c)
+		select {
+		case h.connQueue <- c:
+		default:
+			h.rejectConnection(c)
+		}
+	}
+}
+
+// Shutdown stops accepting new connections and waits for in-flight and
+// already-queued connections to finish, honoring ctx's deadline.
+func (h *HTTP) Shutdown(ctx context.Context) error {
+	close(h.closing)
+
+	// Wait for ServeRequests to assign Listener before reading it: this is
+	// what makes the read safe without a mutex. If ServeRequests never
+	// manages to bind (e.g. it returned early on a Listen error), there's
+	// nothing to close, so return ctx's error once ctx gives up waiting.
+	select {
+	case <-h.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if h.Listener != nil {
+		if err := h.Listener.Close(); err != nil {
+			return fmt.Errorf("closing listener: %w", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
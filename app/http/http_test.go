@@ -0,0 +1,311 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a real server on an ephemeral loopback port and
+// returns its address plus a func that gracefully shuts it down.
+func startTestServer(t *testing.T, directory string) (addr string, shutdown func()) {
+	t.Helper()
+
+	h := NewHTTPServer(directory)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- h.ServeRequests("127.0.0.1", "0") }()
+
+	select {
+	case <-h.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not become ready")
+	}
+
+	return h.Listener.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		<-serveErr
+	}
+}
+
+// readResponse reads one HTTP/1.1 response (status line, headers, and a
+// Content-Length body) off reader.
+func readResponse(t *testing.T, reader *bufio.Reader) (status, body string) {
+	t.Helper()
+
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading status line: %v", err)
+	}
+	status = strings.TrimRight(statusLine, "\r\n")
+
+	contentLength := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading header line: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				t.Fatalf("parsing Content-Length %q: %v", value, err)
+			}
+			contentLength = length
+		}
+	}
+
+	bodyBytes := make([]byte, contentLength)
+	if contentLength > 0 {
+		if _, err := io.ReadFull(reader, bodyBytes); err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+	}
+
+	return status, string(bodyBytes)
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		token    string
+		wantName string
+		wantQ    float64
+	}{
+		{"gzip", "gzip", 1},
+		{" gzip ", "gzip", 1},
+		{"gzip;q=0", "gzip", 0},
+		{"gzip;q=0.5", "gzip", 0.5},
+		{"deflate; q=0.8", "deflate", 0.8},
+	}
+
+	for _, tt := range tests {
+		name, q := parseEncoding(tt.token)
+		if name != tt.wantName || q != tt.wantQ {
+			t.Errorf("parseEncoding(%q) = (%q, %v), want (%q, %v)", tt.token, name, q, tt.wantName, tt.wantQ)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    bool
+	}{
+		{
+			name:    "no Accept-Encoding header",
+			headers: map[string][]string{},
+			want:    false,
+		},
+		{
+			name:    "plain gzip",
+			headers: map[string][]string{"Accept-Encoding": {"gzip"}},
+			want:    true,
+		},
+		{
+			name:    "gzip rejected via q=0",
+			headers: map[string][]string{"Accept-Encoding": {"gzip;q=0"}},
+			want:    false,
+		},
+		{
+			name:    "multiple encodings in one header",
+			headers: map[string][]string{"Accept-Encoding": {"deflate, gzip, br"}},
+			want:    true,
+		},
+		{
+			name:    "gzip absent among other encodings",
+			headers: map[string][]string{"Accept-Encoding": {"deflate, br"}},
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.headers); got != tt.want {
+			t.Errorf("%s: acceptsGzip() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestKeepAliveAndPipelining verifies that a client can pipeline two
+// requests on one connection without waiting for the first response, that
+// both are answered correctly, and that the connection closes after a
+// request carrying Connection: close.
+func TestKeepAliveAndPipelining(t *testing.T) {
+	addr, shutdown := startTestServer(t, "")
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pipelined := "GET /echo/first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /echo/second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(pipelined)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	status, body := readResponse(t, reader)
+	if !strings.Contains(status, "200") || body != "first" {
+		t.Fatalf("first response = (%q, %q), want 200 status and body %q", status, body, "first")
+	}
+
+	status, body = readResponse(t, reader)
+	if !strings.Contains(status, "200") || body != "second" {
+		t.Fatalf("second response = (%q, %q), want 200 status and body %q", status, body, "second")
+	}
+
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection closed (EOF) after Connection: close, got err=%v", err)
+	}
+}
+
+// TestFileUploadRejectsPathTraversal verifies that POST /files/{name} refuses
+// to write outside the served directory when name is a traversal segment.
+func TestFileUploadRejectsPathTraversal(t *testing.T) {
+	addr, shutdown := startTestServer(t, t.TempDir())
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := "escape"
+	request := "POST /files/.. HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	if !strings.Contains(status, "400") {
+		t.Fatalf("status = %q, want 400 Bad Request", status)
+	}
+}
+
+// TestFileUploadWritesFile verifies that a valid application/octet-stream
+// upload is written to the served directory and can be read back unchanged.
+func TestFileUploadWritesFile(t *testing.T) {
+	dir := t.TempDir()
+	addr, shutdown := startTestServer(t, dir)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := "hello from the upload"
+	request := "POST /files/greeting.txt HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	if !strings.Contains(status, "201") {
+		t.Fatalf("status = %q, want 201 Created", status)
+	}
+
+	written, err := os.ReadFile(filepath.Join(dir, "greeting.txt"))
+	if err != nil {
+		t.Fatalf("reading uploaded file: %v", err)
+	}
+	if string(written) != body {
+		t.Fatalf("uploaded file contents = %q, want %q", written, body)
+	}
+}
+
+// TestFileUploadRejectsBadContentType verifies that POST /files/{name}
+// refuses a body whose Content-Type isn't application/octet-stream.
+func TestFileUploadRejectsBadContentType(t *testing.T) {
+	addr, shutdown := startTestServer(t, t.TempDir())
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := "not octet-stream"
+	request := "POST /files/greeting.txt HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	if !strings.Contains(status, "415") {
+		t.Fatalf("status = %q, want 415 Unsupported Media Type", status)
+	}
+}
+
+// BenchmarkServeRequests measures request throughput through the bounded
+// worker pool under concurrent, non-keep-alive client load.
+func BenchmarkServeRequests(b *testing.B) {
+	h := NewHTTPServer("")
+	h.WorkerCount = 32
+	h.QueueSize = 256
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- h.ServeRequests("127.0.0.1", "0") }()
+
+	<-h.Ready()
+	addr := h.Listener.Addr().String()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write([]byte("GET /echo/hello HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")); err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	})
+	b.StopTimer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		b.Fatal(err)
+	}
+	<-serveErr
+}